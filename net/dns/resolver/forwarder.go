@@ -0,0 +1,2369 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package resolver provides a forwarding DNS resolver that forwards
+// queries it can't answer itself out to one or more upstream
+// nameservers, using whichever transport (plain UDP/TCP, DoH, DoT, DoQ,
+// or DNSCrypt) the configured resolver address calls for.
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/salsa20/salsa"
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// headerBytes is the length of a DNS message header.
+	headerBytes = 12
+
+	// optRRType is the RR TYPE value of the EDNS0 OPT pseudo-record.
+	optRRType = 41
+
+	// maxResponseBytes is the largest response we'll accept over UDP
+	// before falling back to TCP. It matches the historical default
+	// EDNS0 UDP payload size advertised elsewhere in this package.
+	maxResponseBytes = 4096
+
+	// dohTransportTimeout bounds how long a single DoH round trip may
+	// take, independent of the caller's context deadline.
+	dohTransportTimeout = 30 * time.Second
+
+	// dnsPort is the default port used by plain DNS (UDP/TCP) and
+	// DNSCrypt upstreams when the configured address doesn't specify
+	// one.
+	dnsPort = "53"
+
+	// dotPort is the default port used by DoT and DoQ upstreams.
+	dotPort = "853"
+)
+
+// preferDoTOverDoH, when set, makes resolversWithDelays upgrade
+// well-known resolver IPs (e.g. 1.1.1.1, 9.9.9.9) to DNS-over-TLS
+// instead of DNS-over-HTTPS. DoH remains the default because it tunnels
+// better through networks that only allow outbound HTTPS.
+var preferDoTOverDoH = envknob.RegisterBool("TS_DNS_FORWARD_PREFER_DOT")
+
+// preferDoQ, when set, makes resolversWithDelays upgrade well-known
+// resolver IPs to DNS-over-QUIC in preference to both DoT and DoH, for
+// providers that advertise a DoQ endpoint. It's off by default while
+// DoQ support is new and less widely deployed than DoT/DoH.
+var preferDoQ = envknob.RegisterBool("TS_DNS_FORWARD_PREFER_DOQ")
+
+// forwardLinkSelector is the interface by which a forwarder picks which
+// network interface to use when dialing upstream resolvers.
+type forwardLinkSelector interface {
+	// PickLink returns the name of the network interface to use to
+	// dial ip, or the empty string to use the default route.
+	PickLink(ip netip.Addr) string
+}
+
+// forwarder forwards DNS packets to a set of upstream nameservers.
+type forwarder struct {
+	logf   logger.Logf
+	netMon *netmon.Monitor
+	// linkSel, if non-nil, is used to pick which network interface to
+	// use to dial out to upstream nameservers.
+	linkSel forwardLinkSelector
+	dialer  *tsdial.Dialer
+	health  *health.Tracker
+
+	dohClientMu sync.Mutex
+	dohClient   map[string]*http.Client // DoH base URL -> client
+
+	upstreamMu    sync.Mutex
+	upstreamCache map[string]Upstream // resolver addr -> its Upstream, reused across queries
+
+	statsMu sync.Mutex
+	stats   map[string]*upstreamStats // resolver addr -> adaptive scheduling stats
+
+	// cache is the forwarder's optional response cache. It's nil unless
+	// EnableResponseCache has been called, in which case send consults
+	// and populates it instead of always going out to the network.
+	cache *responseCache
+}
+
+// newForwarder creates a new forwarder, with the given underlying
+// (possibly nil) link selector and dialer.
+func newForwarder(logf logger.Logf, netMon *netmon.Monitor, linkSel forwardLinkSelector, dialer *tsdial.Dialer, health *health.Tracker) *forwarder {
+	return &forwarder{
+		logf:    logger.WithPrefix(logf, "dns: fwd: "),
+		netMon:  netMon,
+		linkSel: linkSel,
+		dialer:  dialer,
+		health:  health,
+	}
+}
+
+// ResponseCacheOpts configures a forwarder's optional response cache.
+type ResponseCacheOpts struct {
+	// MinTTL and MaxTTL clamp every cached entry's effective TTL,
+	// regardless of what the upstream response advertised.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// PrefetchBefore and PrefetchMinHits control background refresh of
+	// hot entries: an entry is refreshed once its remaining TTL drops
+	// below PrefetchBefore, provided it's been looked up at least
+	// PrefetchMinHits times within the trailing PrefetchWindow.
+	// PrefetchBefore of zero disables prefetching.
+	PrefetchBefore  time.Duration
+	PrefetchMinHits int
+	PrefetchWindow  time.Duration
+
+	// MaxEntries caps how many distinct questions the cache holds. The
+	// cap is enforced by the sweep that store runs once every
+	// sweepEveryStores stores, so between sweeps the cache can hold up
+	// to sweepEveryStores-1 entries more than MaxEntries. Zero means
+	// unbounded, which is only appropriate when the
+	// set of questions a forwarder sees is already bounded some other
+	// way (e.g. a fixed allowlist); production deployments serving
+	// arbitrary queries should set this.
+	MaxEntries int
+}
+
+// EnableResponseCache turns on f's in-memory response cache with the
+// given options, replacing any cache already configured. It must be
+// called before f starts serving queries; send and EnableResponseCache
+// are not safe to call concurrently with each other.
+func (f *forwarder) EnableResponseCache(o ResponseCacheOpts) {
+	f.cache = newResponseCache(o)
+}
+
+// txid identifies a DNS transaction, so multiple racing queries to
+// multiple upstreams can be matched back up with the question that
+// generated them.
+type txid uint16
+
+// getTxID returns the transaction ID of the DNS query or response packet.
+func getTxID(packet []byte) txid {
+	if len(packet) < headerBytes {
+		return 0
+	}
+	return txid(binary.BigEndian.Uint16(packet[:2]))
+}
+
+// getRCode returns the RCODE of the DNS packet, or dns.RCode(5) (refused)
+// if packet is too short to contain one.
+func getRCode(packet []byte) dns.RCode {
+	if len(packet) < headerBytes {
+		return dns.RCode(5)
+	}
+	return dns.RCode(packet[3] & 0x0F)
+}
+
+// nameFromQuery extracts the DNS name from the first question in packet.
+func nameFromQuery(packet []byte) (dnsname.FQDN, error) {
+	var parser dns.Parser
+	if _, err := parser.Start(packet); err != nil {
+		return "", err
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return "", err
+	}
+	return dnsname.ToFQDN(q.Name.String())
+}
+
+// closePool is a synchronized set of io.Closers that get closed
+// together, typically used to unblock an in-flight read on a
+// connection once the query that started it is abandoned.
+type closePool struct {
+	mu      sync.Mutex
+	closed  bool
+	closers []io.Closer
+}
+
+// add registers c to be closed when the pool is closed. If the pool has
+// already been closed, c is closed immediately.
+func (p *closePool) add(c io.Closer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close()
+		return
+	}
+	p.closers = append(p.closers, c)
+}
+
+// Close closes every io.Closer added to the pool. It is safe to call
+// from multiple goroutines and more than once.
+func (p *closePool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	for _, c := range p.closers {
+		c.Close()
+	}
+	p.closers = nil
+	return nil
+}
+
+// closePoolCtxKey is the context.Value key an Upstream implementation
+// uses to find the closePool of the query it's currently servicing, so
+// connections it opens get torn down promptly if the query is
+// abandoned.
+type closePoolCtxKey struct{}
+
+// contextWithClosePool returns a context that carries p, retrievable
+// with closePoolFromContext.
+func contextWithClosePool(ctx context.Context, p *closePool) context.Context {
+	return context.WithValue(ctx, closePoolCtxKey{}, p)
+}
+
+// closePoolFromContext returns the closePool previously attached to ctx
+// with contextWithClosePool, or nil if there isn't one.
+func closePoolFromContext(ctx context.Context) *closePool {
+	p, _ := ctx.Value(closePoolCtxKey{}).(*closePool)
+	return p
+}
+
+// forwardQuery is a query being forwarded to one or more upstream
+// resolvers.
+type forwardQuery struct {
+	txid   txid
+	packet []byte
+
+	// closeOnCtxDone holds connections that should be closed as soon as
+	// this query's context is done, to unblock any goroutine currently
+	// blocked reading a response for it.
+	closeOnCtxDone *closePool
+}
+
+// resolverAndDelay is a resolver to forward a query to, and an optional
+// delay to wait before forwarding to it. Delays are used to stagger
+// queries to redundant upstreams (e.g. a DoH endpoint and its plain-DNS
+// IPs) so that the preferred transport gets a head start.
+type resolverAndDelay struct {
+	// name is the upstream resolver to forward to.
+	name *dnstype.Resolver
+	// startDelay is an amount of time to wait before sending the query.
+	startDelay time.Duration
+}
+
+// knownUpstream describes a well-known public resolver IP's preferred
+// upgrade path.
+type knownUpstream struct {
+	addr  string        // replacement/associated resolver address (DoH, DoT or DoQ URL)
+	delay time.Duration // stagger delay to apply to the original IP
+	keep  bool          // whether to also query the original IP, in addition to addr
+}
+
+// dohSpec is the DoH base URL and stagger delay for a well-known
+// resolver IP.
+type dohSpec struct {
+	provider string
+	delay    time.Duration
+}
+
+// dohIPDelays maps well-known public resolver IPs to their DoH base URL
+// and the delay to apply before also querying the plain IP directly, as
+// a redundant fallback in case the DoH endpoint is unreachable.
+var dohIPDelays = map[string]dohSpec{
+	"8.8.8.8":              {"https://dns.google/dns-query", 500 * time.Millisecond},
+	"8.8.4.4":              {"https://dns.google/dns-query", 700 * time.Millisecond},
+	"2001:4860:4860::8888": {"https://dns.google/dns-query", 500 * time.Millisecond},
+	"2001:4860:4860::8844": {"https://dns.google/dns-query", 700 * time.Millisecond},
+	"9.9.9.9":              {"https://dns.quad9.net/dns-query", 500 * time.Millisecond},
+	"2620:fe::fe":          {"https://dns.quad9.net/dns-query", 500 * time.Millisecond},
+	"2620:fe::9":           {"https://dns.quad9.net/dns-query", 700 * time.Millisecond},
+}
+
+// dotUpgradeByIP maps well-known public resolver IPs to a DNS-over-TLS
+// address, used instead of DoH when preferDoTOverDoH is set.
+var dotUpgradeByIP = map[string]string{
+	"1.1.1.1":     "tls://1.1.1.1#cloudflare-dns.com",
+	"1.0.0.1":     "tls://1.0.0.1#cloudflare-dns.com",
+	"9.9.9.9":     "tls://9.9.9.9#dns.quad9.net",
+	"2620:fe::9":  "tls://2620:fe::9#dns.quad9.net",
+	"2620:fe::fe": "tls://2620:fe::fe#dns.quad9.net",
+}
+
+// doqUpgradeByIP maps well-known public resolver IPs to a DNS-over-QUIC
+// address, used instead of DoT or DoH when preferDoQ is set.
+var doqUpgradeByIP = map[string]string{
+	"1.1.1.1":     "quic://1.1.1.1#cloudflare-dns.com",
+	"1.0.0.1":     "quic://1.0.0.1#cloudflare-dns.com",
+	"9.9.9.9":     "quic://9.9.9.9#dns.quad9.net",
+	"2620:fe::9":  "quic://2620:fe::9#dns.quad9.net",
+	"2620:fe::fe": "quic://2620:fe::fe#dns.quad9.net",
+}
+
+// nextDNSv6Prefixes are the IPv6 ranges NextDNS anycasts its per-user
+// DoH endpoints in, with the configuration ID encoded in the low 48
+// bits of the address.
+var nextDNSv6Prefixes = []netip.Prefix{
+	netip.MustParsePrefix("2a07:a8c0::/32"), // anonymous
+	netip.MustParsePrefix("2a07:a8c1::/32"), // linked to a device
+}
+
+// nextDNSDoHEndpoint returns the DoH URL NextDNS serves for ip, if ip is
+// one of NextDNS's per-configuration anycast addresses.
+func nextDNSDoHEndpoint(ip netip.Addr) (string, bool) {
+	if !ip.Is6() {
+		return "", false
+	}
+	for _, p := range nextDNSv6Prefixes {
+		if !p.Contains(ip) {
+			continue
+		}
+		a := ip.As16()
+		id := a[10:16]
+		for len(id) > 0 && id[0] == 0 {
+			id = id[1:]
+		}
+		if len(id) == 0 {
+			return "", false
+		}
+		return "https://dns.nextdns.io/" + hex.EncodeToString(id), true
+	}
+	return "", false
+}
+
+// nextDNSDoQEndpoint returns the DoQ address NextDNS serves for ip, if
+// ip is one of NextDNS's per-configuration anycast addresses.
+func nextDNSDoQEndpoint(ip netip.Addr) (string, bool) {
+	doh, ok := nextDNSDoHEndpoint(ip)
+	if !ok {
+		return "", false
+	}
+	id := strings.TrimPrefix(doh, "https://dns.nextdns.io/")
+	return "quic://" + id + ".dns.nextdns.io", true
+}
+
+// classifyKnownResolver reports whether ip is a well-known public
+// resolver IP that should be upgraded to a better transport, and how.
+func classifyKnownResolver(ip netip.Addr) (knownUpstream, bool) {
+	s := ip.String()
+	if preferDoQ() {
+		if addr, ok := doqUpgradeByIP[s]; ok {
+			return knownUpstream{addr: addr}, true
+		}
+		if doq, ok := nextDNSDoQEndpoint(ip); ok {
+			return knownUpstream{addr: doq}, true
+		}
+	}
+	if preferDoTOverDoH() {
+		if addr, ok := dotUpgradeByIP[s]; ok {
+			return knownUpstream{addr: addr}, true
+		}
+	}
+	if spec, ok := dohIPDelays[s]; ok {
+		return knownUpstream{addr: spec.provider, delay: spec.delay, keep: true}, true
+	}
+	if doh, ok := nextDNSDoHEndpoint(ip); ok {
+		return knownUpstream{addr: doh}, true
+	}
+	return knownUpstream{}, false
+}
+
+// resolversWithDelays returns the provided resolvers, expanded to
+// include any well-known upgrade paths (DoH, DoT, or DoQ) for resolvers
+// whose address is a bare, publicly-known IP. When an upgrade is found, the
+// upgraded resolver is queried first, and (for providers that also
+// offer a redundant plain-DNS fallback) the original IP is queried
+// after a short stagger delay.
+func resolversWithDelays(resolvers []*dnstype.Resolver) []resolverAndDelay {
+	var out []resolverAndDelay
+	addedUpstream := make(map[string]bool)
+
+	for _, r := range resolvers {
+		ip, err := netip.ParseAddr(r.Addr)
+		if err != nil {
+			// Not a bare IP (already a URL, or some other transport
+			// scheme); pass it through unchanged.
+			out = append(out, resolverAndDelay{name: r})
+			continue
+		}
+
+		ku, ok := classifyKnownResolver(ip)
+		if !ok {
+			out = append(out, resolverAndDelay{name: r})
+			continue
+		}
+
+		if !addedUpstream[ku.addr] {
+			addedUpstream[ku.addr] = true
+			out = append(out, resolverAndDelay{name: &dnstype.Resolver{Addr: ku.addr}})
+		}
+		if ku.keep {
+			out = append(out, resolverAndDelay{name: r, startDelay: ku.delay})
+		}
+	}
+
+	return out
+}
+
+// send forwards fq to rr, waiting out rr's startDelay first, and
+// returns the raw DNS response it got back. The latency and outcome of
+// the attempt are fed back into rr's upstream stats, used by
+// orderedResolvers to adapt future scheduling.
+func (f *forwarder) send(ctx context.Context, fq *forwardQuery, rr resolverAndDelay) ([]byte, error) {
+	if f.cache != nil {
+		if resp, needsPrefetch, ok := f.cache.lookup(fq.packet, fq.txid); ok {
+			if needsPrefetch {
+				f.prefetch(fq.packet, rr)
+			}
+			return resp, nil
+		}
+	}
+
+	resp, err := f.exchange(ctx, fq, rr)
+	if err == nil && f.cache != nil {
+		f.cache.store(fq.packet, resp)
+	}
+	return resp, err
+}
+
+// exchange sends fq to rr's upstream and returns its raw response,
+// bypassing the response cache. send and prefetch are the only
+// callers; everything else should call send.
+func (f *forwarder) exchange(ctx context.Context, fq *forwardQuery, rr resolverAndDelay) ([]byte, error) {
+	if rr.startDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(rr.startDelay):
+		}
+	}
+
+	addr := rr.name.Addr
+	u, err := f.upstreamFor(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = contextWithClosePool(ctx, fq.closeOnCtxDone)
+	start := time.Now()
+	resp, err := u.Exchange(ctx, fq.packet)
+	f.recordResult(addr, time.Since(start), resp, err)
+	return resp, err
+}
+
+// prefetch refreshes a hot, soon-to-expire cache entry in the
+// background, re-querying rr's upstream with the same question. It
+// always starts a refresh; send only calls it when lookup reports
+// needsPrefetch, which lookup does not do while a prefetch for the
+// entry is already in flight.
+func (f *forwarder) prefetch(query []byte, rr resolverAndDelay) {
+	go func() {
+		defer f.cache.endPrefetch(query)
+
+		ctx, cancel := context.WithTimeout(context.Background(), dohTransportTimeout)
+		defer cancel()
+		fq := &forwardQuery{
+			txid:           getTxID(query),
+			packet:         query,
+			closeOnCtxDone: new(closePool),
+		}
+		defer fq.closeOnCtxDone.Close()
+
+		resp, err := f.exchange(ctx, fq, resolverAndDelay{name: rr.name})
+		if err != nil {
+			return
+		}
+		f.cache.store(query, resp)
+		f.cache.prefetches.Add(1)
+	}()
+}
+
+// upstreamFor returns the Upstream for addr, constructing and caching
+// one via AddressToUpstream if this is the first time addr has been
+// seen. The cached Upstream (and any pooled connections it holds) is
+// reused by every later query to the same addr.
+func (f *forwarder) upstreamFor(addr string) (Upstream, error) {
+	f.upstreamMu.Lock()
+	defer f.upstreamMu.Unlock()
+	if f.upstreamCache == nil {
+		f.upstreamCache = make(map[string]Upstream)
+	}
+	if u, ok := f.upstreamCache[addr]; ok {
+		return u, nil
+	}
+
+	u, err := AddressToUpstream(addr, WithDialer(f.dialer), WithLogf(f.logf))
+	if err != nil {
+		return nil, err
+	}
+	f.upstreamCache[addr] = u
+	return u, nil
+}
+
+// recordResult feeds the outcome of a query to addr into its adaptive
+// scheduling stats: a SERVFAIL or transport error counts as a failure
+// (penalizing the upstream with exponential backoff), anything else
+// updates its EWMA RTT.
+func (f *forwarder) recordResult(addr string, rtt time.Duration, resp []byte, err error) {
+	s := f.statsFor(addr)
+	if err != nil || getRCode(resp) == dns.RCodeServerFailure {
+		s.recordFailure()
+		return
+	}
+	s.recordSuccess(rtt)
+}
+
+// statsFor returns the upstreamStats for addr, creating it if
+// necessary.
+func (f *forwarder) statsFor(addr string) *upstreamStats {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	if f.stats == nil {
+		f.stats = make(map[string]*upstreamStats)
+	}
+	s, ok := f.stats[addr]
+	if !ok {
+		s = new(upstreamStats)
+		f.stats[addr] = s
+	}
+	return s
+}
+
+const (
+	// minStagger is the smallest gap adaptive scheduling will ever put
+	// between two successive upstream attempts.
+	minStagger = 100 * time.Millisecond
+
+	// maxStagger caps how long adaptive scheduling will delay a
+	// fallback upstream, so one very slow upstream can't starve the
+	// rest of the list.
+	maxStagger = 2 * time.Second
+
+	// minSamplesForAdaptive is how many completed queries the leading
+	// upstream needs before we trust its EWMA RTT over the static
+	// bootstrap delays from resolversWithDelays.
+	minSamplesForAdaptive = 8
+
+	ewmaAlpha = 0.3
+
+	failureBackoffBase = time.Second
+	failureBackoffCap  = 60 * time.Second
+)
+
+// upstreamStats is a rolling estimate of one upstream resolver's
+// health, used to order and stagger queries across redundant
+// upstreams. The zero value is ready to use.
+type upstreamStats struct {
+	mu             sync.Mutex
+	ewmaRTT        time.Duration
+	samples        int
+	consecFailures int
+	penalizedUntil time.Time
+}
+
+func (s *upstreamStats) recordSuccess(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.samples == 0 {
+		s.ewmaRTT = rtt
+	} else {
+		s.ewmaRTT = time.Duration(ewmaAlpha*float64(rtt) + (1-ewmaAlpha)*float64(s.ewmaRTT))
+	}
+	s.samples++
+	s.consecFailures = 0
+	s.penalizedUntil = time.Time{}
+}
+
+func (s *upstreamStats) recordFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples++
+	s.consecFailures++
+	shift := s.consecFailures - 1
+	if shift > 6 {
+		shift = 6
+	}
+	backoff := failureBackoffBase << shift
+	if backoff > failureBackoffCap {
+		backoff = failureBackoffCap
+	}
+	s.penalizedUntil = time.Now().Add(backoff)
+}
+
+func (s *upstreamStats) snapshot() (ewmaRTT time.Duration, samples, consecFailures int, penalized bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ewmaRTT, s.samples, s.consecFailures, time.Now().Before(s.penalizedUntil)
+}
+
+// orderedResolvers returns resolvers expanded and ordered for
+// querying: resolversWithDelays' static, well-known bootstrap ordering
+// until this forwarder has collected enough samples about the leading
+// upstream's real-world latency, after which upstreams are reordered
+// fastest-healthy-first and staggered proportionally to the leader's
+// observed EWMA RTT, with recently-failing upstreams pushed to the
+// back.
+func (f *forwarder) orderedResolvers(resolvers []*dnstype.Resolver) []resolverAndDelay {
+	rrs := resolversWithDelays(resolvers)
+	if len(rrs) < 2 {
+		return rrs
+	}
+
+	type scored struct {
+		rr        resolverAndDelay
+		ewmaRTT   time.Duration
+		seen      bool
+		penalized bool
+	}
+	scoredRRs := make([]scored, len(rrs))
+	for i, rr := range rrs {
+		ewmaRTT, samples, _, penalized := f.statsFor(rr.name.Addr).snapshot()
+		scoredRRs[i] = scored{rr: rr, ewmaRTT: ewmaRTT, seen: samples >= minSamplesForAdaptive, penalized: penalized}
+	}
+
+	leader := scoredRRs[0]
+	for _, s := range scoredRRs {
+		if s.seen && (!leader.seen || s.ewmaRTT < leader.ewmaRTT) {
+			leader = s
+		}
+	}
+	if !leader.seen {
+		// Not enough data yet; stick with the static bootstrap order.
+		return rrs
+	}
+
+	sort.SliceStable(scoredRRs, func(i, j int) bool {
+		if scoredRRs[i].penalized != scoredRRs[j].penalized {
+			return !scoredRRs[i].penalized
+		}
+		if scoredRRs[i].seen != scoredRRs[j].seen {
+			return scoredRRs[i].seen
+		}
+		return scoredRRs[i].ewmaRTT < scoredRRs[j].ewmaRTT
+	})
+
+	step := leader.ewmaRTT + time.Duration(rand.Int63n(int64(20*time.Millisecond)))
+	if step < minStagger {
+		step = minStagger
+	}
+
+	out := make([]resolverAndDelay, len(scoredRRs))
+	for i, s := range scoredRRs {
+		delay := time.Duration(i) * step
+		if delay > maxStagger {
+			delay = maxStagger
+		}
+		out[i] = resolverAndDelay{name: s.rr.name, startDelay: delay}
+	}
+	return out
+}
+
+// forward sends packet to resolvers and returns the first successful
+// response. resolvers is expanded and ordered by orderedResolvers, so
+// the fastest healthy upstream (per its recent EWMA RTT and failure
+// history) is queried first and the rest are staggered in behind it;
+// once one attempt succeeds, the rest are abandoned via fq's
+// closePool.
+func (f *forwarder) forward(ctx context.Context, packet []byte, resolvers []*dnstype.Resolver) ([]byte, error) {
+	rrs := f.orderedResolvers(resolvers)
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("no upstream resolvers configured")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fq := &forwardQuery{
+		txid:           getTxID(packet),
+		packet:         packet,
+		closeOnCtxDone: new(closePool),
+	}
+	defer fq.closeOnCtxDone.Close()
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	results := make(chan result, len(rrs))
+	for _, rr := range rrs {
+		rr := rr
+		go func() {
+			resp, err := f.send(ctx, fq, rr)
+			select {
+			case results <- result{resp, err}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	var firstErr error
+	for range rrs {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				return r.resp, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, firstErr
+}
+
+// DebugUpstreamStat is a snapshot of one upstream's adaptive scheduling
+// state, suitable for JSON-encoding in a debug handler.
+type DebugUpstreamStat struct {
+	Addr           string        `json:"addr"`
+	EWMARTT        time.Duration `json:"ewmaRTT"`
+	Samples        int           `json:"samples"`
+	ConsecFailures int           `json:"consecFailures"`
+	Penalized      bool          `json:"penalized"`
+}
+
+// DebugStats returns a snapshot of every upstream this forwarder has
+// recorded adaptive scheduling stats for.
+func (f *forwarder) DebugStats() []DebugUpstreamStat {
+	f.statsMu.Lock()
+	addrs := make([]string, 0, len(f.stats))
+	stats := make(map[string]*upstreamStats, len(f.stats))
+	for addr, s := range f.stats {
+		addrs = append(addrs, addr)
+		stats[addr] = s
+	}
+	f.statsMu.Unlock()
+
+	sort.Strings(addrs)
+	out := make([]DebugUpstreamStat, 0, len(addrs))
+	for _, addr := range addrs {
+		ewmaRTT, samples, consecFailures, penalized := stats[addr].snapshot()
+		out = append(out, DebugUpstreamStat{
+			Addr:           addr,
+			EWMARTT:        ewmaRTT,
+			Samples:        samples,
+			ConsecFailures: consecFailures,
+			Penalized:      penalized,
+		})
+	}
+	return out
+}
+
+// ServeDebugUpstreams is an http.HandlerFunc that dumps the current
+// adaptive upstream stats as JSON, for mounting on the daemon's debug
+// mux.
+func (f *forwarder) ServeDebugUpstreams(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.DebugStats())
+}
+
+// DebugCacheStat is the hit/miss/prefetch counters of a forwarder's
+// response cache, suitable for JSON-encoding in a debug handler. It's
+// the zero value, with no error, if the cache isn't enabled.
+type DebugCacheStat struct {
+	Enabled    bool  `json:"enabled"`
+	Entries    int   `json:"entries"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Prefetches int64 `json:"prefetches"`
+}
+
+// DebugCacheStats returns a snapshot of the response cache's counters.
+func (f *forwarder) DebugCacheStats() DebugCacheStat {
+	if f.cache == nil {
+		return DebugCacheStat{}
+	}
+	return f.cache.snapshot()
+}
+
+// ServeDebugCache is an http.HandlerFunc that dumps the current
+// response cache counters as JSON, for mounting on the daemon's debug
+// mux.
+func (f *forwarder) ServeDebugCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.DebugCacheStats())
+}
+
+// Upstream is a DNS transport to a single upstream nameserver. It lets
+// new transports be added without touching forwarder's dispatch logic:
+// forwarder.send only ever calls AddressToUpstream and Exchange.
+type Upstream interface {
+	// Exchange sends req, a raw DNS message, to the upstream and
+	// returns its raw DNS response.
+	Exchange(ctx context.Context, req []byte) ([]byte, error)
+	// Close releases any resources (such as pooled connections) held
+	// by the Upstream.
+	Close() error
+	// Address returns the resolver address the Upstream was
+	// constructed from.
+	Address() string
+}
+
+// Option configures an Upstream constructed by AddressToUpstream.
+type Option func(*upstreamOpts)
+
+type upstreamOpts struct {
+	dialer *tsdial.Dialer
+	logf   logger.Logf
+
+	// rootCAs overrides the system root certificate pool used to
+	// verify a DoT upstream's certificate. It's unexported: there's no
+	// public Option to set it, and it exists only so tests can point a
+	// dotUpstream at a server presenting a test certificate.
+	rootCAs *x509.CertPool
+}
+
+// WithDialer sets the dialer an Upstream uses to reach its resolver.
+// It's required for every scheme except "https://", which uses the
+// default HTTP transport when no dialer is set. A "sdns://" upstream
+// sends both its certificate fetch and its DNSCrypt queries through it.
+func WithDialer(d *tsdial.Dialer) Option {
+	return func(o *upstreamOpts) { o.dialer = d }
+}
+
+// WithLogf sets the logger an Upstream uses for non-fatal warnings.
+func WithLogf(logf logger.Logf) Option {
+	return func(o *upstreamOpts) { o.logf = logf }
+}
+
+// AddressToUpstream constructs the Upstream transport implied by the
+// scheme of addr:
+//
+//   - a bare IP (optionally "ip:port"): UDP, falling back to TCP
+//   - "tcp://host[:port]": TCP only
+//   - "tls://host[:port][#sni]": DNS-over-TLS (RFC 7858)
+//   - "https://...": DNS-over-HTTPS (RFC 8484)
+//   - "quic://host[:port]": DNS-over-QUIC (RFC 9250)
+//   - "sdns://...": DNSCrypt, per a DNS stamp
+//
+// The returned Upstream should be Closed once it's no longer needed.
+func AddressToUpstream(addr string, opts ...Option) (Upstream, error) {
+	var o upstreamOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "https://"):
+		return newDoHUpstream(addr, o), nil
+	case strings.HasPrefix(addr, "tls://"):
+		return newDoTUpstream(addr, o)
+	case strings.HasPrefix(addr, "tcp://"):
+		return newTCPUpstream(addr, o)
+	case strings.HasPrefix(addr, "quic://"):
+		return newDoQUpstream(addr, o)
+	case strings.HasPrefix(addr, "sdns://"):
+		return newDNSCryptUpstream(addr, o)
+	default:
+		return newUDPTCPUpstream(addr, o), nil
+	}
+}
+
+// withDefaultPort returns addr with port appended, unless addr already
+// specifies one.
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+// readTCPResponse reads a single 2-byte length-prefixed DNS message
+// from r, as used by the TCP, DoT and DoQ transports.
+func readTCPResponse(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("reading length header: %w", err)
+	}
+	resp := make([]byte, length)
+	if _, err := io.ReadFull(r, resp); err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	return resp, nil
+}
+
+// udpTCPUpstream implements Upstream for a bare resolver IP: UDP
+// first, falling back to TCP if the response doesn't fit in a single
+// datagram. This is the original, default transport.
+type udpTCPUpstream struct {
+	addr   string
+	dialer *tsdial.Dialer
+}
+
+func newUDPTCPUpstream(addr string, o upstreamOpts) *udpTCPUpstream {
+	return &udpTCPUpstream{addr: addr, dialer: o.dialer}
+}
+
+func (u *udpTCPUpstream) Address() string { return u.addr }
+func (u *udpTCPUpstream) Close() error    { return nil }
+
+func (u *udpTCPUpstream) Exchange(ctx context.Context, req []byte) ([]byte, error) {
+	resp, truncated, err := sendUDP(ctx, u.dialer, u.addr, req)
+	if err != nil {
+		return nil, err
+	}
+	if !truncated {
+		return resp, nil
+	}
+	return sendTCP(ctx, u.dialer, u.addr, req)
+}
+
+// tcpOnlyUpstream implements Upstream for a "tcp://host[:port]"
+// resolver address, forcing TCP even when UDP would've worked.
+type tcpOnlyUpstream struct {
+	addr   string
+	dialer *tsdial.Dialer
+}
+
+func newTCPUpstream(addr string, o upstreamOpts) (*tcpOnlyUpstream, error) {
+	host := strings.TrimPrefix(addr, "tcp://")
+	if host == "" {
+		return nil, fmt.Errorf("invalid TCP resolver address %q", addr)
+	}
+	return &tcpOnlyUpstream{addr: withDefaultPort(host, dnsPort), dialer: o.dialer}, nil
+}
+
+func (u *tcpOnlyUpstream) Address() string { return u.addr }
+func (u *tcpOnlyUpstream) Close() error    { return nil }
+
+func (u *tcpOnlyUpstream) Exchange(ctx context.Context, req []byte) ([]byte, error) {
+	return sendTCP(ctx, u.dialer, u.addr, req)
+}
+
+// sendUDP sends req to addr over UDP and reports whether the response
+// looks truncated, either because the TC bit is set or because it's
+// larger than we're willing to accept over UDP, in which case the
+// caller should retry over TCP.
+func sendUDP(ctx context.Context, dialer *tsdial.Dialer, addr string, req []byte) (resp []byte, truncated bool, err error) {
+	addr = withDefaultPort(addr, dnsPort)
+	conn, err := dialer.SystemDial(ctx, "udp", addr)
+	if err != nil {
+		return nil, false, fmt.Errorf("dialing %q: %w", addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, false, fmt.Errorf("writing to %q: %w", addr, err)
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading from %q: %w", addr, err)
+	}
+	resp = buf[:n]
+
+	truncated = (len(resp) >= 3 && resp[2]&0x02 != 0) || len(resp) > maxResponseBytes
+	return resp, truncated, nil
+}
+
+// sendTCP sends req to addr over a single-use TCP connection, framed
+// with the 2-byte length prefix used by DNS-over-TCP. If ctx carries a
+// closePool (see contextWithClosePool), the connection is registered
+// with it instead of being closed via defer, so an abandoned query
+// unblocks the read immediately rather than waiting out the deadline.
+func sendTCP(ctx context.Context, dialer *tsdial.Dialer, addr string, req []byte) ([]byte, error) {
+	addr = withDefaultPort(addr, dnsPort)
+	conn, err := dialer.SystemDial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %q: %w", addr, err)
+	}
+	if p := closePoolFromContext(ctx); p != nil {
+		p.add(conn)
+	} else {
+		defer conn.Close()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(req)))
+	if _, err := conn.Write(append(lenBuf, req...)); err != nil {
+		return nil, fmt.Errorf("writing to %q: %w", addr, err)
+	}
+
+	return readTCPResponse(conn)
+}
+
+// dotAddr is a parsed "tls://host[:port][#sni]" resolver address.
+type dotAddr struct {
+	hostport string // host:port to dial
+	sni      string // server name to present and verify during the TLS handshake
+}
+
+// parseDoTAddr parses a DoT resolver address of the form
+// "tls://host[:port]" or "tls://host[:port]#sniHostname", the latter
+// form letting the SNI/certificate name differ from the dial address,
+// for pinning to a specific provider by IP.
+func parseDoTAddr(addr string) (dotAddr, error) {
+	rest, ok := strings.CutPrefix(addr, "tls://")
+	if !ok {
+		return dotAddr{}, fmt.Errorf("invalid DoT address %q", addr)
+	}
+	hostport, sni, _ := strings.Cut(rest, "#")
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, dotPort)
+	}
+	if sni == "" {
+		sni, _, _ = net.SplitHostPort(hostport)
+	}
+	return dotAddr{hostport: hostport, sni: sni}, nil
+}
+
+// dotUpstream implements Upstream using a pooled, persistent
+// DNS-over-TLS connection to a single upstream nameserver.
+type dotUpstream struct {
+	addr    string
+	da      dotAddr
+	dialer  *tsdial.Dialer
+	rootCAs *x509.CertPool // nil to verify against the system root pool
+
+	// ioMu serializes the write+read round trip on conn. See Exchange.
+	ioMu sync.Mutex
+
+	mu   sync.Mutex // guards conn
+	conn *tls.Conn
+}
+
+func newDoTUpstream(addr string, o upstreamOpts) (*dotUpstream, error) {
+	da, err := parseDoTAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dotUpstream{addr: addr, da: da, dialer: o.dialer, rootCAs: o.rootCAs}, nil
+}
+
+func (u *dotUpstream) Address() string { return u.addr }
+
+func (u *dotUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closeLocked()
+	return nil
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, req []byte) ([]byte, error) {
+	// ioMu, not u.mu, serializes the write+read round trip: a single
+	// TLS/TCP stream (unlike DoQ's multiplexed QUIC streams) can only
+	// carry one in-flight DNS message at a time. u.mu is only held
+	// briefly, to get or dial the shared conn, exactly as doqUpstream
+	// does for its QUIC connection.
+	u.ioMu.Lock()
+	defer u.ioMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	conn, err := u.connLocked(ctx)
+	u.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// If this query is abandoned (its ctx is done) while the round trip
+	// is in flight, force-close conn to unblock the read below rather
+	// than hang onto ioMu (and the shared conn) forever; the failed read
+	// invalidates conn, so the next Exchange call redials. Once this
+	// Exchange returns, conn stays open for reuse.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Time{}) // clear any deadline left by an earlier query
+	}
+
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(req)))
+	if _, err := conn.Write(append(lenBuf, req...)); err != nil {
+		u.invalidate(conn)
+		return nil, fmt.Errorf("writing to %q: %w", u.addr, err)
+	}
+
+	resp, err := readTCPResponse(conn)
+	if err != nil {
+		u.invalidate(conn)
+		return nil, fmt.Errorf("reading from %q: %w", u.addr, err)
+	}
+	return resp, nil
+}
+
+// connLocked returns a connected, certificate-verified TLS connection
+// to u.da, reusing u.conn if one is already established. u.mu must be
+// held by the caller.
+func (u *dotUpstream) connLocked(ctx context.Context) (*tls.Conn, error) {
+	if u.conn != nil {
+		return u.conn, nil
+	}
+
+	rawConn, err := u.dialer.SystemDial(ctx, "tcp", u.da.hostport)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %q: %w", u.da.hostport, err)
+	}
+
+	conn := tls.Client(rawConn, &tls.Config{ServerName: u.da.sni, RootCAs: u.rootCAs})
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("TLS handshake with %q (SNI %q): %w", u.da.hostport, u.da.sni, err)
+	}
+
+	u.conn = conn
+	return conn, nil
+}
+
+// invalidate closes conn and forgets it, so the next query redials,
+// unless u's connection has already been replaced or closed by
+// someone else (e.g. a concurrent Close).
+func (u *dotUpstream) invalidate(conn *tls.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == conn {
+		u.conn = nil
+	}
+	conn.Close()
+}
+
+// closeLocked closes and forgets u's current connection, so the next
+// query redials. u.mu must be held by the caller.
+func (u *dotUpstream) closeLocked() {
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+}
+
+// knownDoHProviders are the exact DoH base URLs we have dedicated
+// clients for, beyond the dynamically-generated NextDNS ones.
+var knownDoHProviders = map[string]bool{
+	"https://dns.google/dns-query":    true,
+	"https://dns.quad9.net/dns-query": true,
+}
+
+// quicHandshakeBudget bounds how long a DoQ upstream will wait for a
+// QUIC handshake before giving up and falling back to DoT/UDP, so a
+// single unreachable DoQ endpoint doesn't stall every query to it.
+const quicHandshakeBudget = 2 * time.Second
+
+// quicAddr is a parsed "quic://host[:port][#sni]" resolver address.
+type quicAddr struct {
+	hostport string
+	sni      string
+}
+
+// parseQUICAddr parses a DoQ resolver address, same syntax as
+// parseDoTAddr.
+func parseQUICAddr(addr string) (quicAddr, error) {
+	rest, ok := strings.CutPrefix(addr, "quic://")
+	if !ok {
+		return quicAddr{}, fmt.Errorf("invalid DoQ address %q", addr)
+	}
+	hostport, sni, _ := strings.Cut(rest, "#")
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, dotPort) // RFC 9250 shares port 853 with DoT
+	}
+	if sni == "" {
+		sni, _, _ = net.SplitHostPort(hostport)
+	}
+	return quicAddr{hostport: hostport, sni: sni}, nil
+}
+
+// doqUpstream implements Upstream using DNS-over-QUIC (RFC 9250). Each
+// query opens a new bidirectional stream on a shared, pooled QUIC
+// connection; the connection itself is reused (with 0-RTT resumption
+// when the TLS session cache allows it) across queries.
+//
+// If the QUIC handshake doesn't complete within quicHandshakeBudget,
+// or any later step of the QUIC exchange fails, Exchange degrades to a
+// DoT upstream at the same host (or to plain UDP/TCP, if the DoT
+// exchange fails too), so one flaky DoQ endpoint doesn't take down
+// resolution entirely.
+type doqUpstream struct {
+	addr    string
+	qa      quicAddr
+	dialer  *tsdial.Dialer
+	logf    logger.Logf
+	rootCAs *x509.CertPool // nil to verify against the system root pool
+
+	// sessionCache carries TLS session tickets across dials, so a
+	// reconnect to the same upstream (e.g. after the prior conn's
+	// context expired) can resume with 0-RTT instead of a full
+	// handshake.
+	sessionCache tls.ClientSessionCache
+
+	mu   sync.Mutex
+	conn quic.Connection
+
+	fbMu sync.Mutex
+	fb   Upstream // lazily-built fallback, used once DoQ proves unreachable
+}
+
+func newDoQUpstream(addr string, o upstreamOpts) (*doqUpstream, error) {
+	qa, err := parseQUICAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &doqUpstream{
+		addr:         addr,
+		qa:           qa,
+		dialer:       o.dialer,
+		logf:         o.logf,
+		rootCAs:      o.rootCAs,
+		sessionCache: tls.NewLRUClientSessionCache(1),
+	}, nil
+}
+
+func (u *doqUpstream) Address() string { return u.addr }
+
+func (u *doqUpstream) Close() error {
+	u.mu.Lock()
+	if u.conn != nil {
+		u.conn.CloseWithError(0, "")
+		u.conn = nil
+	}
+	u.mu.Unlock()
+
+	u.fbMu.Lock()
+	fb := u.fb
+	u.fb = nil
+	u.fbMu.Unlock()
+	if fb != nil {
+		return fb.Close()
+	}
+	return nil
+}
+
+func (u *doqUpstream) Exchange(ctx context.Context, req []byte) ([]byte, error) {
+	resp, err := u.exchangeQUIC(ctx, req)
+	if err == nil {
+		return resp, nil
+	}
+	if u.logf != nil {
+		u.logf("dns: doq: %q unreachable, falling back: %v", u.addr, err)
+	}
+	fb := u.fallbackUpstream()
+	resp, err = fb.Exchange(ctx, req)
+	if err == nil {
+		return resp, nil
+	}
+	if _, isDoT := fb.(*dotUpstream); !isDoT {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(u.qa.hostport)
+	return newUDPTCPUpstream(host, upstreamOpts{dialer: u.dialer}).Exchange(ctx, req)
+}
+
+func (u *doqUpstream) exchangeQUIC(ctx context.Context, req []byte) ([]byte, error) {
+	u.mu.Lock()
+	conn, err := u.connLocked(ctx)
+	u.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		u.invalidate(conn)
+		return nil, fmt.Errorf("opening QUIC stream to %q: %w", u.addr, err)
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// Frame the query like the DoT/TCP transports, with a 2-byte
+	// length prefix, for codec symmetry with readTCPResponse.
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(req)))
+	if _, err := stream.Write(append(lenBuf, req...)); err != nil {
+		u.invalidate(conn)
+		return nil, fmt.Errorf("writing to %q: %w", u.addr, err)
+	}
+	stream.Close() // done writing; the resolver may now send its response
+
+	return readTCPResponse(stream)
+}
+
+// connLocked returns a connected QUIC connection to u.qa, reusing
+// u.conn if it's still open. u.mu must be held by the caller.
+func (u *doqUpstream) connLocked(ctx context.Context) (quic.Connection, error) {
+	if u.conn != nil {
+		select {
+		case <-u.conn.Context().Done():
+			u.conn = nil
+		default:
+			return u.conn, nil
+		}
+	}
+
+	hctx, cancel := context.WithTimeout(ctx, quicHandshakeBudget)
+	defer cancel()
+
+	rawConn, err := u.dialer.SystemDial(hctx, "udp", u.qa.hostport)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %q: %w", u.qa.hostport, err)
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp", u.qa.hostport)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	// SystemDial only ever returns a net.Conn, not a net.PacketConn (its
+	// result is a wrapper around the dialer's netns/exit-node-aware
+	// socket, not necessarily a concrete *net.UDPConn we could assert
+	// to). quic.Dial needs a net.PacketConn, so adapt the connected
+	// net.Conn into one rather than bypassing the dialer with a bare
+	// net.ListenUDP/net.DialUDP.
+	pc := &connPacketConn{Conn: rawConn, remoteAddr: remoteAddr}
+
+	tlsConf := &tls.Config{
+		ServerName:         u.qa.sni,
+		NextProtos:         []string{"doq"},
+		RootCAs:            u.rootCAs,
+		ClientSessionCache: u.sessionCache,
+	}
+	conn, err := quic.Dial(hctx, pc, remoteAddr, tlsConf, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("QUIC handshake with %q: %w", u.qa.hostport, err)
+	}
+
+	u.conn = conn
+	return conn, nil
+}
+
+// connPacketConn adapts a connected net.Conn, as returned by
+// tsdial.Dialer.SystemDial for the "udp" network, to the net.PacketConn
+// interface quic.Dial requires. The conn is already connected to
+// exactly one remote (remoteAddr), so ReadFrom reports it as the
+// source of every read and WriteTo ignores its addr argument, which is
+// always remoteAddr in practice.
+type connPacketConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *connPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, err = c.Conn.Read(p)
+	return n, c.remoteAddr, err
+}
+
+func (c *connPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return c.Conn.Write(p)
+}
+
+// invalidate drops u.conn if it's still the one passed in, so the next
+// Exchange redials instead of reusing a connection a stream error was
+// just seen on.
+func (u *doqUpstream) invalidate(bad quic.Connection) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == bad {
+		u.conn = nil
+	}
+}
+
+// fallbackUpstream lazily builds (once) and returns the non-QUIC
+// upstream to use when this DoQ endpoint is unreachable: DoT at the
+// same host and SNI if possible, else plain UDP/TCP.
+func (u *doqUpstream) fallbackUpstream() Upstream {
+	u.fbMu.Lock()
+	defer u.fbMu.Unlock()
+	if u.fb != nil {
+		return u.fb
+	}
+
+	host, _, _ := net.SplitHostPort(u.qa.hostport)
+	o := upstreamOpts{dialer: u.dialer, logf: u.logf, rootCAs: u.rootCAs}
+	if dot, err := newDoTUpstream(fmt.Sprintf("tls://%s#%s", host, u.qa.sni), o); err == nil {
+		u.fb = dot
+	} else {
+		u.fb = newUDPTCPUpstream(host, o)
+	}
+	return u.fb
+}
+
+// isKnownDoHURL reports whether urlBase is a DoH endpoint this package
+// knows how to build a dedicated client for.
+func isKnownDoHURL(urlBase string) bool {
+	if knownDoHProviders[urlBase] {
+		return true
+	}
+	return strings.HasPrefix(urlBase, "https://dns.nextdns.io/")
+}
+
+// getKnownDoHClientForProvider returns a cached *http.Client for the
+// well-known DoH base URL urlBase, creating one if necessary. It
+// reports false if urlBase isn't a recognized DoH provider.
+func (f *forwarder) getKnownDoHClientForProvider(urlBase string) (*http.Client, bool) {
+	if !isKnownDoHURL(urlBase) {
+		return nil, false
+	}
+
+	f.dohClientMu.Lock()
+	defer f.dohClientMu.Unlock()
+	if f.dohClient == nil {
+		f.dohClient = make(map[string]*http.Client)
+	}
+	if c, ok := f.dohClient[urlBase]; ok {
+		return c, true
+	}
+
+	c := &http.Client{Timeout: dohTransportTimeout}
+	if f.dialer != nil {
+		c.Transport = &http.Transport{
+			DialContext: f.dialer.SystemDial,
+		}
+	}
+	f.dohClient[urlBase] = c
+	return c, true
+}
+
+const dohContentType = "application/dns-message"
+
+// dohUpstream implements Upstream using DNS-over-HTTPS (RFC 8484).
+type dohUpstream struct {
+	addr   string
+	client *http.Client
+}
+
+func newDoHUpstream(addr string, o upstreamOpts) *dohUpstream {
+	c := &http.Client{Timeout: dohTransportTimeout}
+	if o.dialer != nil {
+		c.Transport = &http.Transport{DialContext: o.dialer.SystemDial}
+	}
+	return &dohUpstream{addr: addr, client: c}
+}
+
+func (u *dohUpstream) Address() string { return u.addr }
+func (u *dohUpstream) Close() error    { return nil }
+
+func (u *dohUpstream) Exchange(ctx context.Context, req []byte) ([]byte, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", u.addr, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("DoH request to %q: %w", u.addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH request to %q: unexpected status %v", u.addr, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+}
+
+// skipName advances past a (possibly compressed) DNS name encoded
+// starting at off, returning the offset immediately following it.
+func skipName(packet []byte, off int) (int, bool) {
+	for {
+		if off >= len(packet) {
+			return 0, false
+		}
+		l := int(packet[off])
+		switch {
+		case l == 0:
+			return off + 1, true
+		case l&0xC0 == 0xC0:
+			if off+2 > len(packet) {
+				return 0, false
+			}
+			return off + 2, true
+		case l&0xC0 != 0:
+			return 0, false
+		default:
+			off++
+			if off+l > len(packet) {
+				return 0, false
+			}
+			off += l
+		}
+	}
+}
+
+// skipResource advances past a single resource record (name, fixed
+// header and rdata) starting at off, returning the offset following it.
+func skipResource(packet []byte, off int) (int, bool) {
+	off, ok := skipName(packet, off)
+	if !ok || off+10 > len(packet) {
+		return 0, false
+	}
+	rdlen := int(binary.BigEndian.Uint16(packet[off+8 : off+10]))
+	off += 10
+	if off+rdlen > len(packet) {
+		return 0, false
+	}
+	return off + rdlen, true
+}
+
+// clampEDNSSize ensures that the EDNS0 UDP payload size advertised by
+// an OPT pseudo-record in packet's additional section, if any, is no
+// larger than maxSize. This keeps us from promising an upstream a
+// larger reply than we're able to relay back to the querying client.
+// packet is returned unmodified if it can't be parsed, has no OPT
+// record, or its advertised size is already within maxSize.
+func clampEDNSSize(packet []byte, maxSize uint16) []byte {
+	if len(packet) < headerBytes {
+		return packet
+	}
+
+	qd := binary.BigEndian.Uint16(packet[4:6])
+	an := binary.BigEndian.Uint16(packet[6:8])
+	ns := binary.BigEndian.Uint16(packet[8:10])
+	ar := binary.BigEndian.Uint16(packet[10:12])
+	if ar == 0 {
+		return packet
+	}
+
+	off := headerBytes
+	for i := uint16(0); i < qd; i++ {
+		var ok bool
+		off, ok = skipName(packet, off)
+		if !ok || off+4 > len(packet) {
+			return packet
+		}
+		off += 4 // type + class
+	}
+	for _, n := range [2]uint16{an, ns} {
+		for i := uint16(0); i < n; i++ {
+			var ok bool
+			off, ok = skipResource(packet, off)
+			if !ok {
+				return packet
+			}
+		}
+	}
+
+	for i := uint16(0); i < ar; i++ {
+		nameEnd, ok := skipName(packet, off)
+		if !ok || nameEnd+10 > len(packet) {
+			return packet
+		}
+		rtype := binary.BigEndian.Uint16(packet[nameEnd : nameEnd+2])
+		rdlen := int(binary.BigEndian.Uint16(packet[nameEnd+8 : nameEnd+10]))
+		rdataStart := nameEnd + 10
+		if rdataStart+rdlen > len(packet) {
+			return packet
+		}
+		if rtype == optRRType {
+			classOff := nameEnd + 2
+			if binary.BigEndian.Uint16(packet[classOff:classOff+2]) > maxSize {
+				out := append([]byte(nil), packet...)
+				binary.BigEndian.PutUint16(out[classOff:classOff+2], maxSize)
+				return out
+			}
+			return packet
+		}
+		off = rdataStart + rdlen
+	}
+
+	return packet
+}
+
+// dnsCryptStamp is the information recovered from parsing an
+// "sdns://..." DNS Stamp (https://dnscrypt.info/stamps-specifications)
+// for a DNSCrypt v2 resolver.
+type dnsCryptStamp struct {
+	addr         string   // resolver host:port
+	serverPK     [32]byte // provider's long-term Ed25519 public key, pinned for certificate verification
+	providerName string   // e.g. "2.dnscrypt.default.ns1.example.com"
+}
+
+const dnsCryptStampProtocol = 0x01 // DNSCrypt, per the DNS Stamps spec
+
+// parseDNSCryptStamp decodes an "sdns://" URI into a dnsCryptStamp.
+func parseDNSCryptStamp(stampURI string) (dnsCryptStamp, error) {
+	rest, ok := strings.CutPrefix(stampURI, "sdns://")
+	if !ok {
+		return dnsCryptStamp{}, fmt.Errorf("not a DNS stamp: %q", stampURI)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(rest)
+	if err != nil {
+		return dnsCryptStamp{}, fmt.Errorf("decoding DNS stamp: %w", err)
+	}
+	const propsLen = 8 // 8-byte little-endian properties bitmask, unused here
+	if len(raw) < 1+propsLen {
+		return dnsCryptStamp{}, fmt.Errorf("DNS stamp too short")
+	}
+	if raw[0] != dnsCryptStampProtocol {
+		return dnsCryptStamp{}, fmt.Errorf("DNS stamp protocol %#x is not DNSCrypt", raw[0])
+	}
+
+	off := 1 + propsLen
+	addrBytes, off, err := readStampLP(raw, off)
+	if err != nil {
+		return dnsCryptStamp{}, fmt.Errorf("reading stamp address: %w", err)
+	}
+	pk, off, err := readStampLP(raw, off)
+	if err != nil {
+		return dnsCryptStamp{}, fmt.Errorf("reading stamp public key: %w", err)
+	}
+	if len(pk) != ed25519.PublicKeySize {
+		return dnsCryptStamp{}, fmt.Errorf("DNS stamp public key is %d bytes, want %d", len(pk), ed25519.PublicKeySize)
+	}
+	providerName, _, err := readStampLP(raw, off)
+	if err != nil {
+		return dnsCryptStamp{}, fmt.Errorf("reading stamp provider name: %w", err)
+	}
+
+	var s dnsCryptStamp
+	s.addr = withDefaultPort(string(addrBytes), dnsPort)
+	copy(s.serverPK[:], pk)
+	s.providerName = string(providerName)
+	return s, nil
+}
+
+// readStampLP reads a single-byte-length-prefixed field from b at off,
+// returning the field and the offset of the byte following it.
+func readStampLP(b []byte, off int) (field []byte, newOff int, err error) {
+	if off >= len(b) {
+		return nil, 0, fmt.Errorf("truncated stamp")
+	}
+	n := int(b[off])
+	off++
+	if off+n > len(b) {
+		return nil, 0, fmt.Errorf("truncated stamp")
+	}
+	return b[off : off+n], off + n, nil
+}
+
+// DNSCrypt certificate constructions (the "ES version" field of a
+// certificate), per the DNSCrypt v2 spec.
+const (
+	esVersionXSalsa20Poly1305  = 0x0001
+	esVersionXChaCha20Poly1305 = 0x0002
+)
+
+var dnsCryptCertMagic = [4]byte{'D', 'N', 'S', 'C'}
+
+// dnsCryptCert is a parsed, signature-verified DNSCrypt server
+// certificate: the short-term key and AEAD construction to use for
+// queries until tsEnd.
+type dnsCryptCert struct {
+	esVersion   uint16
+	serverPK    [32]byte // short-term X25519 public key
+	clientMagic [8]byte  // prefix clients must prepend to every query
+	serial      uint32
+	tsStart     uint32
+	tsEnd       uint32
+}
+
+func (c dnsCryptCert) expired(now time.Time) bool {
+	u := uint32(now.Unix())
+	return u < c.tsStart || u >= c.tsEnd
+}
+
+// parseDNSCryptCert parses and verifies a raw certificate (the RDATA of
+// the TXT record fetched for the stamp's provider name) against
+// providerPK, the provider's pinned long-term Ed25519 public key.
+func parseDNSCryptCert(raw []byte, providerPK [32]byte) (dnsCryptCert, error) {
+	const sigLen = ed25519.SignatureSize
+	const signedLen = 32 + 8 + 4 + 4 + 4 // serverPK + clientMagic + serial + tsStart + tsEnd
+	const headerLen = 4 + 2 + 2          // magic + esVersion + minorVersion
+	if len(raw) < headerLen+sigLen+signedLen {
+		return dnsCryptCert{}, fmt.Errorf("DNSCrypt certificate too short")
+	}
+	if !bytes.Equal(raw[:4], dnsCryptCertMagic[:]) {
+		return dnsCryptCert{}, fmt.Errorf("DNSCrypt certificate has the wrong magic")
+	}
+	esVersion := binary.BigEndian.Uint16(raw[4:6])
+	sig := raw[headerLen : headerLen+sigLen]
+	signed := raw[headerLen+sigLen:]
+	if !ed25519.Verify(providerPK[:], signed, sig) {
+		return dnsCryptCert{}, fmt.Errorf("DNSCrypt certificate signature verification failed")
+	}
+
+	var c dnsCryptCert
+	c.esVersion = esVersion
+	copy(c.serverPK[:], signed[0:32])
+	copy(c.clientMagic[:], signed[32:40])
+	c.serial = binary.BigEndian.Uint32(signed[40:44])
+	c.tsStart = binary.BigEndian.Uint32(signed[44:48])
+	c.tsEnd = binary.BigEndian.Uint32(signed[48:52])
+	return c, nil
+}
+
+// buildDNSCryptCertQuery builds a plaintext TXT query for the
+// certificate record of providerName.
+func buildDNSCryptCertQuery(providerName string) ([]byte, error) {
+	fqdn, err := dnsname.ToFQDN(providerName)
+	if err != nil {
+		return nil, fmt.Errorf("building DNSCrypt cert query: %w", err)
+	}
+	name, err := dns.NewName(string(fqdn))
+	if err != nil {
+		return nil, fmt.Errorf("building DNSCrypt cert query: %w", err)
+	}
+	b := dns.NewBuilder(nil, dns.Header{ID: uint16(rand.Uint32()), RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dns.Question{Name: name, Type: dns.TypeTXT, Class: dns.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseDNSCryptCertTXT extracts the concatenated TXT strings of the
+// first TXT answer record in resp.
+func parseDNSCryptCertTXT(resp []byte) ([]byte, error) {
+	var p dns.Parser
+	if _, err := p.Start(resp); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	for {
+		hdr, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Type != dns.TypeTXT {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		txt, err := p.TXTResource()
+		if err != nil {
+			return nil, err
+		}
+		var out []byte
+		for _, s := range txt.TXT {
+			out = append(out, s...)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("no TXT certificate record found")
+}
+
+// padQuery pads req to a multiple of 64 bytes (minimum 256) with a
+// 0x80 byte followed by zeros, per the DNSCrypt v2 padding scheme.
+func padQuery(req []byte) []byte {
+	const blockSize = 64
+	const minSize = 256
+	size := len(req) + 1
+	if size < minSize {
+		size = minSize
+	}
+	if rem := size % blockSize; rem != 0 {
+		size += blockSize - rem
+	}
+	padded := make([]byte, size)
+	copy(padded, req)
+	padded[len(req)] = 0x80
+	return padded
+}
+
+// unpadResponse reverses padQuery, returning an error if the padding
+// is malformed.
+func unpadResponse(padded []byte) ([]byte, error) {
+	for i := len(padded) - 1; i >= 0; i-- {
+		switch padded[i] {
+		case 0:
+			continue
+		case 0x80:
+			return padded[:i], nil
+		default:
+			return nil, fmt.Errorf("malformed DNSCrypt padding")
+		}
+	}
+	return nil, fmt.Errorf("malformed DNSCrypt padding")
+}
+
+var dnsCryptResolverMagic = [8]byte{'r', '6', 'f', 'n', 'v', 'W', 'j', '8'}
+
+// dnscryptUpstream is an Upstream that speaks DNSCrypt v2
+// (https://dnscrypt.info/protocol) to the server described by an
+// "sdns://" stamp, with UDP as the primary transport and TCP fallback
+// on truncation, matching the other Do53-family transports.
+type dnscryptUpstream struct {
+	addr   string
+	stamp  dnsCryptStamp
+	dialer *tsdial.Dialer
+	logf   logger.Logf
+
+	mu       sync.Mutex
+	cert     dnsCryptCert
+	haveCert bool
+}
+
+func newDNSCryptUpstream(addr string, o upstreamOpts) (*dnscryptUpstream, error) {
+	stamp, err := parseDNSCryptStamp(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dnscryptUpstream{addr: addr, stamp: stamp, dialer: o.dialer, logf: o.logf}, nil
+}
+
+func (u *dnscryptUpstream) Address() string { return u.addr }
+func (u *dnscryptUpstream) Close() error    { return nil }
+
+// currentCert returns the current, unexpired DNSCrypt certificate for the
+// upstream, fetching and verifying a fresh one over plaintext DNS if
+// needed.
+func (u *dnscryptUpstream) currentCert(ctx context.Context) (dnsCryptCert, error) {
+	u.mu.Lock()
+	if u.haveCert && !u.cert.expired(time.Now()) {
+		cert := u.cert
+		u.mu.Unlock()
+		return cert, nil
+	}
+	u.mu.Unlock()
+
+	q, err := buildDNSCryptCertQuery(u.stamp.providerName)
+	if err != nil {
+		return dnsCryptCert{}, err
+	}
+	resp, _, err := sendUDP(ctx, u.dialer, u.stamp.addr, q)
+	if err != nil {
+		return dnsCryptCert{}, fmt.Errorf("fetching DNSCrypt certificate: %w", err)
+	}
+	rdata, err := parseDNSCryptCertTXT(resp)
+	if err != nil {
+		return dnsCryptCert{}, fmt.Errorf("fetching DNSCrypt certificate: %w", err)
+	}
+	cert, err := parseDNSCryptCert(rdata, u.stamp.serverPK)
+	if err != nil {
+		return dnsCryptCert{}, err
+	}
+	if cert.expired(time.Now()) {
+		return dnsCryptCert{}, fmt.Errorf("DNSCrypt certificate for %q is expired", u.stamp.providerName)
+	}
+
+	u.mu.Lock()
+	u.cert = cert
+	u.haveCert = true
+	u.mu.Unlock()
+	return cert, nil
+}
+
+// invalidateCert drops the cached certificate, forcing the next
+// Exchange to re-fetch it. Used when decryption fails, which usually
+// means the server has rotated to a new certificate.
+func (u *dnscryptUpstream) invalidateCert() {
+	u.mu.Lock()
+	u.haveCert = false
+	u.mu.Unlock()
+}
+
+// dnsCryptSharedKey derives the DNSCrypt shared-secret key for an ECDH
+// exchange between clientSK and serverPK. Both of DNSCrypt's AEAD
+// constructions key their cipher this way: the raw X25519 output is
+// run through HSalsa20 with a zero nonce and the standard "expand
+// 32-byte k" constant, exactly as nacl/box's Seal/Open do internally
+// for the XSalsa20-Poly1305 construction; the XChaCha20-Poly1305
+// construction reuses the same derived key rather than the raw ECDH
+// output.
+func dnsCryptSharedKey(clientSK, serverPK *[32]byte) ([]byte, error) {
+	ecdh, err := curve25519.X25519(clientSK[:], serverPK[:])
+	if err != nil {
+		return nil, err
+	}
+	var rawKey, derivedKey [32]byte
+	copy(rawKey[:], ecdh)
+	var zeroNonce [16]byte
+	salsa.HSalsa20(&derivedKey, &zeroNonce, &rawKey, &salsa.Sigma)
+	return derivedKey[:], nil
+}
+
+func (u *dnscryptUpstream) seal(cert dnsCryptCert, clientSK *[32]byte, nonce [24]byte, padded []byte) ([]byte, error) {
+	switch cert.esVersion {
+	case esVersionXSalsa20Poly1305:
+		return box.Seal(nil, padded, &nonce, &cert.serverPK, clientSK), nil
+	case esVersionXChaCha20Poly1305:
+		shared, err := dnsCryptSharedKey(clientSK, &cert.serverPK)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.NewX(shared)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Seal(nil, nonce[:], padded, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported DNSCrypt construction %#x", cert.esVersion)
+	}
+}
+
+func (u *dnscryptUpstream) open(cert dnsCryptCert, clientSK *[32]byte, nonce [24]byte, ciphertext []byte) ([]byte, error) {
+	switch cert.esVersion {
+	case esVersionXSalsa20Poly1305:
+		padded, ok := box.Open(nil, ciphertext, &nonce, &cert.serverPK, clientSK)
+		if !ok {
+			return nil, fmt.Errorf("DNSCrypt response authentication failed")
+		}
+		return padded, nil
+	case esVersionXChaCha20Poly1305:
+		shared, err := dnsCryptSharedKey(clientSK, &cert.serverPK)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.NewX(shared)
+		if err != nil {
+			return nil, err
+		}
+		padded, err := aead.Open(nil, nonce[:], ciphertext, nil)
+		if err != nil {
+			return nil, fmt.Errorf("DNSCrypt response authentication failed: %w", err)
+		}
+		return padded, nil
+	default:
+		return nil, fmt.Errorf("unsupported DNSCrypt construction %#x", cert.esVersion)
+	}
+}
+
+func (u *dnscryptUpstream) Exchange(ctx context.Context, req []byte) ([]byte, error) {
+	cert, err := u.currentCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clientPK, clientSK, err := box.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	if _, err := cryptorand.Read(nonce[:12]); err != nil { // client half; the server echoes back the full 24 bytes
+		return nil, err
+	}
+
+	ciphertext, err := u.seal(cert, clientSK, nonce, padQuery(req))
+	if err != nil {
+		return nil, err
+	}
+	query := make([]byte, 0, len(cert.clientMagic)+len(clientPK)+12+len(ciphertext))
+	query = append(query, cert.clientMagic[:]...)
+	query = append(query, clientPK[:]...)
+	query = append(query, nonce[:12]...)
+	query = append(query, ciphertext...)
+
+	resp, truncated, err := sendUDP(ctx, u.dialer, u.stamp.addr, query)
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		if resp, err = sendTCP(ctx, u.dialer, u.stamp.addr, query); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(resp) < len(dnsCryptResolverMagic)+24 {
+		return nil, fmt.Errorf("DNSCrypt response too short")
+	}
+	if !bytes.Equal(resp[:8], dnsCryptResolverMagic[:]) {
+		return nil, fmt.Errorf("DNSCrypt response has the wrong magic")
+	}
+	var respNonce [24]byte
+	copy(respNonce[:], resp[8:32])
+
+	padded, err := u.open(cert, clientSK, respNonce, resp[32:])
+	if err != nil {
+		u.invalidateCert()
+		return nil, err
+	}
+	return unpadResponse(padded)
+}
+
+// cacheKey identifies a cached response by its question.
+type cacheKey struct {
+	name  string // lowercased, fully-qualified query name
+	qtype dns.Type
+	class dns.Class
+}
+
+// keyForQuery returns the cacheKey for a raw DNS query packet.
+func keyForQuery(query []byte) (cacheKey, bool) {
+	var p dns.Parser
+	if _, err := p.Start(query); err != nil {
+		return cacheKey{}, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return cacheKey{}, false
+	}
+	return cacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class}, true
+}
+
+// ttlForResponse returns the cache TTL for a raw DNS response packet:
+// the minimum TTL across its answer section, or, for a negative
+// response (NXDOMAIN or NODATA), the lesser of the TTL and the MINIMUM
+// field of the SOA record in its authority section, per RFC 2308. ok is false if resp can't be parsed or isn't
+// cacheable (e.g. SERVFAIL, or a negative response with no SOA).
+func ttlForResponse(resp []byte) (ttl time.Duration, ok bool) {
+	var p dns.Parser
+	hdr, err := p.Start(resp)
+	if err != nil {
+		return 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+
+	var minTTL uint32 = ^uint32(0)
+	haveAnswer := false
+	for {
+		ahdr, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return 0, false
+		}
+		haveAnswer = true
+		if ahdr.TTL < minTTL {
+			minTTL = ahdr.TTL
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return 0, false
+		}
+	}
+	if haveAnswer {
+		if hdr.RCode != dns.RCodeSuccess {
+			return 0, false
+		}
+		return time.Duration(minTTL) * time.Second, true
+	}
+
+	if hdr.RCode != dns.RCodeSuccess && hdr.RCode != dns.RCodeNameError {
+		return 0, false
+	}
+	for {
+		nhdr, err := p.AuthorityHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return 0, false
+		}
+		if nhdr.Type != dns.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return 0, false
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return 0, false
+		}
+		negTTL := nhdr.TTL
+		if soa.MinTTL < negTTL {
+			negTTL = soa.MinTTL
+		}
+		return time.Duration(negTTL) * time.Second, true
+	}
+	return 0, false
+}
+
+// rewriteTXID returns a copy of packet with its transaction ID field
+// overwritten to id.
+func rewriteTXID(packet []byte, id txid) []byte {
+	if len(packet) < 2 {
+		return packet
+	}
+	out := append([]byte(nil), packet...)
+	binary.BigEndian.PutUint16(out[:2], uint16(id))
+	return out
+}
+
+// rewriteTTLs returns a copy of packet with every resource record's
+// TTL field in the answer, authority and additional sections
+// overwritten to remaining seconds (the EDNS0 OPT pseudo-record, whose
+// TTL field holds flags rather than a lifetime, is left alone).
+// packet is returned unmodified if it can't be parsed.
+func rewriteTTLs(packet []byte, remaining uint32) []byte {
+	if len(packet) < headerBytes {
+		return packet
+	}
+	out := append([]byte(nil), packet...)
+
+	qd := binary.BigEndian.Uint16(out[4:6])
+	an := binary.BigEndian.Uint16(out[6:8])
+	ns := binary.BigEndian.Uint16(out[8:10])
+	ar := binary.BigEndian.Uint16(out[10:12])
+
+	off := headerBytes
+	for i := uint16(0); i < qd; i++ {
+		var ok bool
+		off, ok = skipName(out, off)
+		if !ok || off+4 > len(out) {
+			return packet
+		}
+		off += 4 // type + class
+	}
+	for _, n := range [2]uint16{an, ns} {
+		for i := uint16(0); i < n; i++ {
+			nameEnd, ok := skipName(out, off)
+			if !ok || nameEnd+10 > len(out) {
+				return packet
+			}
+			binary.BigEndian.PutUint32(out[nameEnd+4:nameEnd+8], remaining)
+			rdlen := int(binary.BigEndian.Uint16(out[nameEnd+8 : nameEnd+10]))
+			off = nameEnd + 10 + rdlen
+			if off > len(out) {
+				return packet
+			}
+		}
+	}
+	for i := uint16(0); i < ar; i++ {
+		nameEnd, ok := skipName(out, off)
+		if !ok || nameEnd+10 > len(out) {
+			return packet
+		}
+		rtype := binary.BigEndian.Uint16(out[nameEnd : nameEnd+2])
+		rdlen := int(binary.BigEndian.Uint16(out[nameEnd+8 : nameEnd+10]))
+		if rtype != optRRType {
+			binary.BigEndian.PutUint32(out[nameEnd+4:nameEnd+8], remaining)
+		}
+		off = nameEnd + 10 + rdlen
+		if off > len(out) {
+			return packet
+		}
+	}
+	return out
+}
+
+// cacheEntry is a single cached response, keyed by its question
+// elsewhere in responseCache.entries.
+type cacheEntry struct {
+	mu          sync.Mutex
+	packet      []byte        // raw wire response, as received from the upstream
+	ttl         time.Duration // TTL as of arrival
+	arrival     time.Time
+	hits        []time.Time // recent lookup times, for prefetch hot-detection
+	prefetching bool
+}
+
+// recentHitCountLocked trims hits to only those within window of now,
+// and returns how many remain. e.mu must be held.
+func (e *cacheEntry) recentHitCountLocked(now time.Time, window time.Duration) int {
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(e.hits) && !e.hits[i].After(cutoff) {
+		i++
+	}
+	e.hits = e.hits[i:]
+	return len(e.hits)
+}
+
+// sweepEveryStores is how many responseCache.store calls happen
+// between opportunistic sweeps of expired entries, amortizing the cost
+// of a full scan of c.entries rather than doing it on every write.
+const sweepEveryStores = 64
+
+// responseCache is a forwarder's optional in-memory cache of upstream
+// DNS responses, keyed on the question name (case-folded), type and
+// class. See ResponseCacheOpts for its tunables.
+//
+// Left unchecked, entries would grow without bound: expired entries are
+// never actively removed by lookup (it just treats them as a miss), and
+// a forwarder serving arbitrary queries can see an unbounded number of
+// distinct questions. store periodically sweeps out expired entries and,
+// if ResponseCacheOpts.MaxEntries is set, evicts the oldest-arrived
+// entries once over the cap.
+type responseCache struct {
+	opts ResponseCacheOpts
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	stores  int // count of store calls since the last sweepLocked
+
+	hits       atomic.Int64
+	misses     atomic.Int64
+	prefetches atomic.Int64
+}
+
+func newResponseCache(o ResponseCacheOpts) *responseCache {
+	return &responseCache{opts: o, entries: make(map[cacheKey]*cacheEntry)}
+}
+
+func (c *responseCache) entryFor(key cacheKey, create bool) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok && create {
+		e = new(cacheEntry)
+		c.entries[key] = e
+		ok = true
+	}
+	return e, ok
+}
+
+// lookup returns a cached response to query, if one exists and hasn't
+// expired, with its transaction ID rewritten to id and every TTL set
+// to the time remaining. needsPrefetch reports whether the
+// caller should kick off a background refresh via forwarder.prefetch.
+func (c *responseCache) lookup(query []byte, id txid) (resp []byte, needsPrefetch bool, ok bool) {
+	key, ok := keyForQuery(query)
+	if !ok {
+		return nil, false, false
+	}
+	e, found := c.entryFor(key, false)
+	if !found {
+		c.misses.Add(1)
+		return nil, false, false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	remaining := e.ttl - time.Since(e.arrival)
+	if remaining <= 0 {
+		c.misses.Add(1)
+		return nil, false, false
+	}
+	c.hits.Add(1)
+
+	now := time.Now()
+	e.hits = append(e.hits, now)
+
+	if c.opts.PrefetchBefore > 0 && remaining < c.opts.PrefetchBefore && !e.prefetching &&
+		e.recentHitCountLocked(now, c.opts.PrefetchWindow) >= c.opts.PrefetchMinHits {
+		e.prefetching = true
+		needsPrefetch = true
+	}
+
+	resp = rewriteTTLs(rewriteTXID(e.packet, id), uint32(remaining/time.Second))
+	return resp, needsPrefetch, true
+}
+
+// store caches resp as the answer to query, if resp's TTL makes it
+// cacheable.
+func (c *responseCache) store(query, resp []byte) {
+	key, ok := keyForQuery(query)
+	if !ok {
+		return
+	}
+	ttl, ok := ttlForResponse(resp)
+	if !ok {
+		return
+	}
+	if ttl < c.opts.MinTTL {
+		ttl = c.opts.MinTTL
+	}
+	if c.opts.MaxTTL > 0 && ttl > c.opts.MaxTTL {
+		ttl = c.opts.MaxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	e, _ := c.entryFor(key, true)
+	e.mu.Lock()
+	e.packet = append([]byte(nil), resp...)
+	e.ttl = ttl
+	e.arrival = time.Now()
+	e.prefetching = false
+	e.mu.Unlock()
+
+	c.mu.Lock()
+	c.stores++
+	if c.stores >= sweepEveryStores {
+		c.stores = 0
+		c.sweepLocked()
+	}
+	c.mu.Unlock()
+}
+
+// sweepLocked removes expired entries, and, if opts.MaxEntries is set,
+// evicts the oldest-arrived entries until at most MaxEntries remain.
+// c.mu must be held.
+func (c *responseCache) sweepLocked() {
+	now := time.Now()
+	arrivals := make(map[cacheKey]time.Time, len(c.entries))
+	for key, e := range c.entries {
+		e.mu.Lock()
+		// ttl is zero for an entry entryFor just created but whose
+		// concurrent store call hasn't populated yet; leave it alone; it's
+		// not actually expired, just momentarily incomplete.
+		expired := e.ttl > 0 && now.Sub(e.arrival) >= e.ttl
+		arrival := e.arrival
+		e.mu.Unlock()
+		if expired {
+			delete(c.entries, key)
+			continue
+		}
+		arrivals[key] = arrival
+	}
+
+	if c.opts.MaxEntries <= 0 || len(c.entries) <= c.opts.MaxEntries {
+		return
+	}
+	oldest := make([]cacheKey, 0, len(arrivals))
+	for key := range arrivals {
+		oldest = append(oldest, key)
+	}
+	sort.Slice(oldest, func(i, j int) bool {
+		return arrivals[oldest[i]].Before(arrivals[oldest[j]])
+	})
+	for _, key := range oldest[:len(c.entries)-c.opts.MaxEntries] {
+		delete(c.entries, key)
+	}
+}
+
+// endPrefetch clears the in-flight prefetch marker for query's entry,
+// set by a prior lookup that returned needsPrefetch.
+func (c *responseCache) endPrefetch(query []byte) {
+	key, ok := keyForQuery(query)
+	if !ok {
+		return
+	}
+	e, found := c.entryFor(key, false)
+	if !found {
+		return
+	}
+	e.mu.Lock()
+	e.prefetching = false
+	e.mu.Unlock()
+}
+
+func (c *responseCache) snapshot() DebugCacheStat {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+	return DebugCacheStat{
+		Enabled:    true,
+		Entries:    entries,
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Prefetches: c.prefetches.Load(),
+	}
+}
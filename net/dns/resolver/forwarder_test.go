@@ -6,10 +6,17 @@ package resolver
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/netip"
 	"os"
@@ -20,6 +27,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
 	dns "golang.org/x/net/dns/dnsmessage"
 	"tailscale.com/envknob"
 	"tailscale.com/net/netmon"
@@ -112,6 +122,47 @@ func TestResolversWithDelays(t *testing.T) {
 
 }
 
+func TestOrderedResolversAdaptive(t *testing.T) {
+	fwd := newForwarder(t.Logf, nil, nil, nil, nil)
+
+	fast := &dnstype.Resolver{Addr: "127.0.0.1:5300"}
+	slow := &dnstype.Resolver{Addr: "127.0.0.2:5300"}
+	okResp := make([]byte, headerBytes) // RCode success
+
+	// Neither upstream has enough samples yet, so the static bootstrap
+	// order (as given) should be preserved.
+	got := fwd.orderedResolvers([]*dnstype.Resolver{slow, fast})
+	if len(got) != 2 || got[0].name.Addr != slow.Addr || got[1].name.Addr != fast.Addr {
+		t.Fatalf("before sampling: got %v, want static order [slow, fast]", got)
+	}
+
+	for i := 0; i < minSamplesForAdaptive; i++ {
+		fwd.recordResult(slow.Addr, 200*time.Millisecond, okResp, nil)
+		fwd.recordResult(fast.Addr, 10*time.Millisecond, okResp, nil)
+	}
+
+	got = fwd.orderedResolvers([]*dnstype.Resolver{slow, fast})
+	if len(got) != 2 || got[0].name.Addr != fast.Addr || got[1].name.Addr != slow.Addr {
+		t.Fatalf("after sampling: got %v, want fast resolver ordered first", got)
+	}
+	if got[0].startDelay != 0 {
+		t.Errorf("leading resolver got startDelay %v, want 0", got[0].startDelay)
+	}
+	if got[1].startDelay <= 0 {
+		t.Errorf("trailing resolver got startDelay %v, want > 0", got[1].startDelay)
+	}
+
+	// Penalize the fast resolver with consecutive failures; it should
+	// drop to the back even though its EWMA RTT is still lower.
+	for i := 0; i < 3; i++ {
+		fwd.recordResult(fast.Addr, 0, nil, fmt.Errorf("boom"))
+	}
+	got = fwd.orderedResolvers([]*dnstype.Resolver{slow, fast})
+	if len(got) != 2 || got[0].name.Addr != slow.Addr || got[1].name.Addr != fast.Addr {
+		t.Fatalf("after penalizing fast resolver: got %v, want penalized resolver pushed to the back", got)
+	}
+}
+
 func TestGetRCode(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -473,3 +524,549 @@ func TestForwarderTCPFallback(t *testing.T) {
 		t.Errorf("DNS server never saw UDP request")
 	}
 }
+
+// TestForwarderTCPOnlyUpstream exercises the explicit "tcp://" scheme
+// through the same runDNSServer harness as TestForwarderTCPFallback,
+// confirming AddressToUpstream's per-scheme dispatch (rather than
+// fwd.send's bare-IP UDP-then-TCP fallback) picks TCP only.
+func TestForwarderTCPOnlyUpstream(t *testing.T) {
+	const domain = "tcp-only.tailscale.com."
+	response := func() []byte {
+		builder := dns.NewBuilder(nil, dns.Header{})
+		builder.StartQuestions()
+		builder.Question(dns.Question{
+			Name:  dns.MustNewName(domain),
+			Type:  dns.TypeA,
+			Class: dns.ClassINET,
+		})
+		builder.StartAnswers()
+		builder.AResource(dns.ResourceHeader{
+			Name:  dns.MustNewName(domain),
+			Class: dns.ClassINET,
+			TTL:   300,
+		}, dns.AResource{A: [4]byte{127, 0, 0, 1}})
+		msg, err := builder.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}()
+	request := func() []byte {
+		builder := dns.NewBuilder(nil, dns.Header{})
+		builder.StartQuestions()
+		builder.Question(dns.Question{
+			Name:  dns.MustNewName(domain),
+			Type:  dns.TypeA,
+			Class: dns.ClassINET,
+		})
+		msg, err := builder.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}()
+
+	var sawUDPRequest, sawTCPRequest atomic.Bool
+	port := runDNSServer(t, response, func(isTCP bool, gotRequest []byte) {
+		if isTCP {
+			sawTCPRequest.Store(true)
+		} else {
+			sawUDPRequest.Store(true)
+		}
+		if !bytes.Equal(request, gotRequest) {
+			t.Errorf("invalid request\ngot: %+v\nwant: %+v", gotRequest, request)
+		}
+	})
+
+	netMon, err := netmon.New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialer tsdial.Dialer
+	dialer.SetNetMon(netMon)
+
+	fwd := newForwarder(t.Logf, netMon, nil, &dialer, nil)
+
+	fq := &forwardQuery{
+		txid:           getTxID(request),
+		packet:         request,
+		closeOnCtxDone: new(closePool),
+	}
+	defer fq.closeOnCtxDone.Close()
+
+	rr := resolverAndDelay{
+		name: &dnstype.Resolver{Addr: fmt.Sprintf("tcp://127.0.0.1:%d", port)},
+	}
+
+	resp, err := fwd.send(context.Background(), fq, rr)
+	if err != nil {
+		t.Fatalf("error making request: %v", err)
+	}
+	if !bytes.Equal(resp, response) {
+		t.Errorf("invalid response\ngot: %+v\nwant: %+v", resp, response)
+	}
+	if !sawTCPRequest.Load() {
+		t.Errorf("DNS server never saw TCP request")
+	}
+	if sawUDPRequest.Load() {
+		t.Errorf("DNS server unexpectedly saw a UDP request for a tcp:// upstream")
+	}
+}
+
+// generateTestCert returns a self-signed certificate (and its private
+// key), valid for ip, for use by an in-process DoT test server.
+func generateTestCert(t *testing.T, ip net.IP) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: ip.String()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{ip},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, pool
+}
+
+func TestDoTUpstream(t *testing.T) {
+	cert, pool := generateTestCert(t, net.IPv4(127, 0, 0, 1))
+
+	ln, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	request := []byte("a fake DNS query")
+	response := []byte("a fake DNS response")
+
+	var numQueries atomic.Int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var length uint16
+					if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+						return
+					}
+					got := make([]byte, length)
+					if _, err := io.ReadFull(conn, got); err != nil {
+						return
+					}
+					if !bytes.Equal(got, request) {
+						t.Errorf("invalid request\ngot: %+v\nwant: %+v", got, request)
+					}
+					numQueries.Add(1)
+
+					out := make([]byte, 2+len(response))
+					binary.BigEndian.PutUint16(out, uint16(len(response)))
+					copy(out[2:], response)
+					if _, err := conn.Write(out); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	netMon, err := netmon.New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialer tsdial.Dialer
+	dialer.SetNetMon(netMon)
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	addr := fmt.Sprintf("tls://127.0.0.1:%d#127.0.0.1", port)
+	u, err := newDoTUpstream(addr, upstreamOpts{dialer: &dialer, rootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	// Send several queries over the same pooled connection, to
+	// exercise both the handshake/framing and connection reuse.
+	for i := 0; i < 3; i++ {
+		resp, err := u.Exchange(context.Background(), request)
+		if err != nil {
+			t.Fatalf("query #%d: %v", i, err)
+		}
+		if !bytes.Equal(resp, response) {
+			t.Errorf("query #%d: got %q, want %q", i, resp, response)
+		}
+	}
+	if got := numQueries.Load(); got != 3 {
+		t.Errorf("server saw %d queries, want 3", got)
+	}
+
+	// A query whose context is canceled before the server replies must
+	// not wedge the shared connection for later queries.
+	closed := new(closePool)
+	cancelCtx, cancel := context.WithCancel(contextWithClosePool(context.Background(), closed))
+	cancel()
+	closed.Close()
+	if _, err := u.Exchange(cancelCtx, request); err == nil {
+		t.Error("expected an error from a canceled query, got nil")
+	}
+
+	resp, err := u.Exchange(context.Background(), request)
+	if err != nil {
+		t.Fatalf("query after cancellation: %v", err)
+	}
+	if !bytes.Equal(resp, response) {
+		t.Errorf("query after cancellation: got %q, want %q", resp, response)
+	}
+}
+
+func TestDoQUpstream(t *testing.T) {
+	cert, pool := generateTestCert(t, net.IPv4(127, 0, 0, 1))
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ln, err := quic.Listen(pc, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	request := []byte("a fake DNS query")
+	response := []byte("a fake DNS response")
+
+	var numQueries atomic.Int64
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						var length uint16
+						if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+							return
+						}
+						got := make([]byte, length)
+						if _, err := io.ReadFull(stream, got); err != nil {
+							return
+						}
+						if !bytes.Equal(got, request) {
+							t.Errorf("invalid request\ngot: %+v\nwant: %+v", got, request)
+						}
+						numQueries.Add(1)
+
+						out := make([]byte, 2+len(response))
+						binary.BigEndian.PutUint16(out, uint16(len(response)))
+						copy(out[2:], response)
+						stream.Write(out)
+					}()
+				}
+			}()
+		}
+	}()
+
+	netMon, err := netmon.New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialer tsdial.Dialer
+	dialer.SetNetMon(netMon)
+
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	addr := fmt.Sprintf("quic://127.0.0.1:%d#127.0.0.1", port)
+	u, err := newDoQUpstream(addr, upstreamOpts{dialer: &dialer, rootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	// Send several queries over the same pooled QUIC connection, each on
+	// its own stream, to exercise both the handshake/framing and
+	// connection reuse.
+	for i := 0; i < 3; i++ {
+		resp, err := u.Exchange(context.Background(), request)
+		if err != nil {
+			t.Fatalf("query #%d: %v", i, err)
+		}
+		if !bytes.Equal(resp, response) {
+			t.Errorf("query #%d: got %q, want %q", i, resp, response)
+		}
+	}
+	if got := numQueries.Load(); got != 3 {
+		t.Errorf("server saw %d queries, want 3", got)
+	}
+}
+
+func TestDNSCryptSealOpen(t *testing.T) {
+	u := new(dnscryptUpstream)
+
+	for _, esVersion := range []uint16{esVersionXSalsa20Poly1305, esVersionXChaCha20Poly1305} {
+		t.Run(fmt.Sprintf("esVersion=%#x", esVersion), func(t *testing.T) {
+			clientPK, clientSK, err := box.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverPK, serverSK, err := box.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert := dnsCryptCert{esVersion: esVersion, serverPK: *serverPK}
+
+			var nonce [24]byte
+			if _, err := rand.Read(nonce[:]); err != nil {
+				t.Fatal(err)
+			}
+			query := []byte("a fake padded DNS query")
+
+			ciphertext, err := u.seal(cert, clientSK, nonce, query)
+			if err != nil {
+				t.Fatalf("seal: %v", err)
+			}
+
+			// Open from the server's perspective: the AEAD key is derived
+			// from (serverSK, clientPK), which must equal the key seal
+			// derived from (clientSK, serverPK).
+			serverCert := dnsCryptCert{esVersion: esVersion, serverPK: *clientPK}
+			got, err := u.open(serverCert, serverSK, nonce, ciphertext)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if !bytes.Equal(got, query) {
+				t.Errorf("round trip: got %q, want %q", got, query)
+			}
+		})
+	}
+
+	// Regression guard for the XChaCha20-Poly1305 construction: it must
+	// key its AEAD from the HSalsa20-derived shared secret, not the raw
+	// X25519 output (the two differ), or it won't interoperate with a
+	// real resolver advertising this ES version.
+	_, clientSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPK, _, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, err := dnsCryptSharedKey(clientSK, serverPK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := curve25519.X25519(clientSK[:], serverPK[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(derived, raw) {
+		t.Error("dnsCryptSharedKey returned the raw X25519 output; want it HSalsa20-derived")
+	}
+}
+
+func TestForwarderResponseCache(t *testing.T) {
+	const domain = "cached.tailscale.com."
+	name := dns.MustNewName(domain)
+
+	response := func() []byte {
+		builder := dns.NewBuilder(nil, dns.Header{})
+		builder.StartQuestions()
+		builder.Question(dns.Question{
+			Name:  name,
+			Type:  dns.TypeA,
+			Class: dns.ClassINET,
+		})
+		builder.StartAnswers()
+		builder.AResource(dns.ResourceHeader{
+			Name:  name,
+			Class: dns.ClassINET,
+			TTL:   300,
+		}, dns.AResource{A: [4]byte{127, 0, 0, 1}})
+		msg, err := builder.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}()
+
+	request := func() []byte {
+		builder := dns.NewBuilder(nil, dns.Header{})
+		builder.StartQuestions()
+		builder.Question(dns.Question{
+			Name:  name,
+			Type:  dns.TypeA,
+			Class: dns.ClassINET,
+		})
+		msg, err := builder.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}()
+
+	var numRequests atomic.Int64
+	port := runDNSServer(t, response, func(isTCP bool, gotRequest []byte) {
+		numRequests.Add(1)
+		if !bytes.Equal(request, gotRequest) {
+			t.Errorf("invalid request\ngot: %+v\nwant: %+v", gotRequest, request)
+		}
+	})
+
+	netMon, err := netmon.New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dialer tsdial.Dialer
+	dialer.SetNetMon(netMon)
+
+	fwd := newForwarder(t.Logf, netMon, nil, &dialer, nil)
+	fwd.EnableResponseCache(ResponseCacheOpts{MinTTL: time.Second, MaxTTL: time.Hour})
+
+	rr := resolverAndDelay{
+		name: &dnstype.Resolver{Addr: fmt.Sprintf("127.0.0.1:%d", port)},
+	}
+
+	for i := 0; i < 3; i++ {
+		fq := &forwardQuery{
+			txid:           getTxID(request),
+			packet:         request,
+			closeOnCtxDone: new(closePool),
+		}
+		resp, err := fwd.send(context.Background(), fq, rr)
+		fq.closeOnCtxDone.Close()
+		if err != nil {
+			t.Fatalf("send #%d: %v", i, err)
+		}
+		if len(resp) == 0 {
+			t.Fatalf("send #%d: empty response", i)
+		}
+	}
+
+	if got := numRequests.Load(); got != 1 {
+		t.Errorf("got %d upstream requests, want 1", got)
+	}
+	if stats := fwd.DebugCacheStats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("got cache stats %+v, want 2 hits and 1 miss", stats)
+	}
+}
+
+// buildCacheResponse returns a minimal cacheable DNS response for
+// domain, with an answer TTL of ttlSecs.
+func buildCacheResponse(t *testing.T, domain string, ttlSecs uint32) []byte {
+	t.Helper()
+	name := dns.MustNewName(domain)
+	builder := dns.NewBuilder(nil, dns.Header{})
+	builder.StartQuestions()
+	builder.Question(dns.Question{Name: name, Type: dns.TypeA, Class: dns.ClassINET})
+	builder.StartAnswers()
+	builder.AResource(dns.ResourceHeader{
+		Name:  name,
+		Class: dns.ClassINET,
+		TTL:   ttlSecs,
+	}, dns.AResource{A: [4]byte{127, 0, 0, 1}})
+	msg, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func buildCacheQuery(t *testing.T, domain string) []byte {
+	t.Helper()
+	builder := dns.NewBuilder(nil, dns.Header{})
+	builder.StartQuestions()
+	builder.Question(dns.Question{Name: dns.MustNewName(domain), Type: dns.TypeA, Class: dns.ClassINET})
+	msg, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestResponseCacheSweepsExpiredEntries(t *testing.T) {
+	c := newResponseCache(ResponseCacheOpts{MinTTL: time.Millisecond})
+
+	query := buildCacheQuery(t, "expired.tailscale.com.")
+	c.store(query, buildCacheResponse(t, "expired.tailscale.com.", 0))
+	time.Sleep(5 * time.Millisecond)
+
+	if _, found := c.entryFor(mustKeyForQuery(t, query), false); !found {
+		t.Fatal("entry vanished before the sweep ran")
+	}
+
+	c.mu.Lock()
+	c.sweepLocked()
+	n := len(c.entries)
+	c.mu.Unlock()
+
+	if n != 0 {
+		t.Errorf("got %d entries after sweeping an expired one, want 0", n)
+	}
+}
+
+func TestResponseCacheEvictsOverMaxEntries(t *testing.T) {
+	c := newResponseCache(ResponseCacheOpts{MinTTL: time.Hour, MaxEntries: 2})
+
+	domains := []string{"a.tailscale.com.", "b.tailscale.com.", "c.tailscale.com."}
+	for _, d := range domains {
+		c.store(buildCacheQuery(t, d), buildCacheResponse(t, d, 300))
+		time.Sleep(time.Millisecond) // ensure distinct, increasing arrival times
+	}
+
+	c.mu.Lock()
+	c.sweepLocked()
+	n := len(c.entries)
+	_, keptOldest := c.entries[mustKeyForQuery(t, buildCacheQuery(t, domains[0]))]
+	_, keptNewest := c.entries[mustKeyForQuery(t, buildCacheQuery(t, domains[2]))]
+	c.mu.Unlock()
+
+	if n != 2 {
+		t.Errorf("got %d entries after sweeping over MaxEntries, want 2", n)
+	}
+	if keptOldest {
+		t.Error("oldest-arrived entry survived eviction, want it evicted")
+	}
+	if !keptNewest {
+		t.Error("newest-arrived entry was evicted, want it kept")
+	}
+}
+
+func mustKeyForQuery(t *testing.T, query []byte) cacheKey {
+	t.Helper()
+	key, ok := keyForQuery(query)
+	if !ok {
+		t.Fatal("keyForQuery failed")
+	}
+	return key
+}